@@ -0,0 +1,139 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"context"
+	"time"
+)
+
+// aLongTimeAgo is a non-zero time far in the past, used like net/http's
+// Transport does to cancel an in-flight Read/Write by arming an
+// already-expired deadline instead of closing the connection outright.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// SetReadDeadline sets the deadline for future Read calls and any
+// currently-blocked Read call. It is tracked under s.mu so
+// ReadPacketContext can restore it after a context-scoped read, even with
+// other goroutines sharing the Socket.
+func (s *socket) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	err := s.Conn.SetReadDeadline(t)
+	s.mu.Unlock()
+	return err
+}
+
+// SetWriteDeadline sets the deadline for future Write calls and any
+// currently-blocked Write call. It is tracked under s.mu so
+// WritePacketContext can restore it after a context-scoped write, even with
+// other goroutines sharing the Socket.
+func (s *socket) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	err := s.Conn.SetWriteDeadline(t)
+	s.mu.Unlock()
+	return err
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (s *socket) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	err := s.Conn.SetDeadline(t)
+	s.mu.Unlock()
+	return err
+}
+
+// ReadPacketContext reads header and body from the connection, aborting as
+// soon as ctx is done. It uses the same technique as net/http's Transport
+// for per-request cancellation on a shared conn: a watcher goroutine arms
+// SetReadDeadline(aLongTimeAgo) when ctx.Done() fires, unblocking a
+// concurrent ReadPacket without disturbing any deadline another goroutine
+// may have armed for itself.
+func (s *socket) ReadPacketContext(ctx context.Context, packet *Packet) error {
+	if ctx.Done() == nil {
+		return s.ReadPacket(packet)
+	}
+	stopWatcher := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.Conn.SetReadDeadline(aLongTimeAgo)
+			s.mu.Unlock()
+		case <-stopWatcher:
+		}
+	}()
+	err := s.ReadPacket(packet)
+	// Stop the watcher and wait for it to actually finish before inspecting
+	// or restoring the deadline: otherwise it can still be in flight (or can
+	// have just won the ctx.Done()/stopWatcher race) and clobber the
+	// deadline with aLongTimeAgo right after we've decided to leave it alone.
+	close(stopWatcher)
+	<-watcherDone
+	if ctx.Err() != nil {
+		s.restoreReadDeadline()
+		return ctx.Err()
+	}
+	return err
+}
+
+// WritePacketContext writes header and body to the connection, aborting as
+// soon as ctx is done. See ReadPacketContext for the cancellation technique.
+func (s *socket) WritePacketContext(ctx context.Context, packet *Packet) error {
+	if ctx.Done() == nil {
+		return s.WritePacket(packet)
+	}
+	stopWatcher := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.Conn.SetWriteDeadline(aLongTimeAgo)
+			s.mu.Unlock()
+		case <-stopWatcher:
+		}
+	}()
+	err := s.WritePacket(packet)
+	// See ReadPacketContext: wait for the watcher to fully finish before
+	// touching the deadline, so it can't clobber our restore afterwards.
+	close(stopWatcher)
+	<-watcherDone
+	if ctx.Err() != nil {
+		s.restoreWriteDeadline()
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *socket) restoreReadDeadline() {
+	s.mu.Lock()
+	s.Conn.SetReadDeadline(s.readDeadline)
+	s.mu.Unlock()
+}
+
+func (s *socket) restoreWriteDeadline() {
+	s.mu.Lock()
+	s.Conn.SetWriteDeadline(s.writeDeadline)
+	s.mu.Unlock()
+}
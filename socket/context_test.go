@@ -0,0 +1,166 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReadPacketContextCancellationReturnsCtxErr drives ReadPacketContext
+// over a net.Pipe where nothing is ever written, so it would block forever
+// without cancellation, and asserts the caller sees ctx.Err() rather than a
+// raw timeout error from the deadline the watcher goroutine arms.
+func TestReadPacketContextCancellationReturnsCtxErr(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	s := NewSocket(client).(*socket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ReadPacketContext(ctx, new(Packet)) }()
+
+	time.Sleep(20 * time.Millisecond) // let ReadPacketContext block in Unpack first
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("ReadPacketContext() = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadPacketContext did not return after ctx was cancelled")
+	}
+}
+
+// TestReadPacketContextRestoresDeadlineAfterCancellation asserts that once a
+// cancelled ReadPacketContext returns, the watcher's aLongTimeAgo deadline has
+// actually been undone: an ordinary ReadPacket call right after must block
+// normally (waiting for the peer) instead of failing instantly with a stale
+// timeout. This is the exact invariant the deadline-watcher race fix exists
+// to guarantee.
+func TestReadPacketContextRestoresDeadlineAfterCancellation(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	s := NewSocket(client).(*socket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := s.ReadPacketContext(ctx, new(Packet)); err != context.Canceled {
+		t.Fatalf("ReadPacketContext() = %v, want context.Canceled", err)
+	}
+
+	readDone := make(chan error, 1)
+	go func() { readDone <- s.ReadPacket(new(Packet)) }()
+	select {
+	case err := <-readDone:
+		t.Fatalf("ReadPacket returned immediately after a cancelled ReadPacketContext (deadline left stuck): %v", err)
+	case <-time.After(50 * time.Millisecond):
+		// Still blocked, as expected for a peer that hasn't written anything yet.
+	}
+
+	ss := NewSocket(server).(*socket)
+	if err := ss.WritePacket(new(Packet)); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+	if err := <-readDone; err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+}
+
+// TestWritePacketContextCancellationDoesNotDisturbReadDeadline exercises two
+// concurrent "goroutines" sharing a Socket: one owns the read side and has
+// armed its own long-lived read deadline (the documented idle-timeout
+// pattern); the other drives a WritePacketContext that gets cancelled. The
+// write-side watcher must only ever touch writeDeadline, never readDeadline,
+// or it corrupts state another goroutine is relying on.
+func TestWritePacketContextCancellationDoesNotDisturbReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	s := NewSocket(client).(*socket)
+
+	readDeadline := time.Now().Add(time.Hour)
+	if err := s.SetReadDeadline(readDeadline); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	// Nothing ever reads from server, so this blocks until cancelled.
+	if err := s.WritePacketContext(ctx, new(Packet)); err != context.Canceled {
+		t.Fatalf("WritePacketContext() = %v, want context.Canceled", err)
+	}
+
+	s.mu.RLock()
+	got := s.readDeadline
+	s.mu.RUnlock()
+	if !got.Equal(readDeadline) {
+		t.Fatalf("readDeadline after a cancelled WritePacketContext = %v, want untouched %v", got, readDeadline)
+	}
+}
+
+// TestContextPacketRaceStress hammers WritePacketContext and plain
+// SetReadDeadline calls from many goroutines at once. It makes no behavioral assertion beyond completing cleanly; its
+// value is in catching the deadline-watcher race (the one fixed by commit
+// 4b5b9e1) when run with `go test -race`.
+func TestContextPacketRaceStress(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	s := NewSocket(client).(*socket)
+	ss := NewSocket(server).(*socket)
+	go func() {
+		for {
+			if ss.ReadPacket(new(Packet)) != nil {
+				return
+			}
+		}
+	}()
+
+	const n = 20
+	done := make(chan struct{}, n*2)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+			s.WritePacketContext(ctx, new(Packet))
+		}()
+		go func() {
+			defer func() { done <- struct{}{} }()
+			s.SetReadDeadline(time.Now().Add(time.Millisecond))
+		}()
+	}
+	for i := 0; i < n*2; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,134 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSessionStreamDataExchange opens a Stream end-to-end over a net.Pipe
+// pair of Sessions and exchanges a payload several times larger than both
+// MaxFrameSize and MaxReceiveBuffer/2, so the round trip necessarily spans
+// multiple PSH frames and at least one WIN credit update.
+func TestSessionStreamDataExchange(t *testing.T) {
+	clientCfg := &SessionConfig{Client: true, MaxFrameSize: 16, MaxReceiveBuffer: 64, AcceptBacklog: 4}
+	serverCfg := &SessionConfig{MaxFrameSize: 16, MaxReceiveBuffer: 64, AcceptBacklog: 4}
+
+	c1, c2 := net.Pipe()
+	sess1, err := NewSession(NewSocket(c1), clientCfg)
+	if err != nil {
+		t.Fatalf("NewSession (client): %v", err)
+	}
+	defer sess1.Close()
+	sess2, err := NewSession(NewSocket(c2), serverCfg)
+	if err != nil {
+		t.Fatalf("NewSession (server): %v", err)
+	}
+	defer sess2.Close()
+
+	st1, err := sess1.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	defer st1.Close()
+
+	acceptErr := make(chan error, 1)
+	stCh := make(chan *Stream, 1)
+	go func() {
+		st2, err := sess2.AcceptStream()
+		stCh <- st2
+		acceptErr <- err
+	}()
+
+	payload := bytes.Repeat([]byte("ab"), 40) // 80 bytes: > MaxFrameSize(16) and > MaxReceiveBuffer/2(32)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := st1.Write(payload)
+		writeErr <- err
+	}()
+
+	if err := <-acceptErr; err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	st2 := <-stCh
+	defer st2.Close()
+
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(st2, got); err != nil {
+		t.Fatalf("Stream.Read: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("Stream.Write: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+}
+
+// TestSessionFailUnblocksPendingStreamIO asserts the smux issue #68
+// invariant documented on Session.fail: when the underlying Socket dies out
+// from under the Session (e.g. a dropped TCP connection), every blocked
+// Stream.Read/Write must unblock with an error instead of hanging forever,
+// and the Session itself must report closed.
+func TestSessionFailUnblocksPendingStreamIO(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// Drain the peer end: net.Pipe writes block until read, and OpenStream
+	// only returns once its SYN frame has actually been written.
+	go io.Copy(io.Discard, c2)
+
+	sess, err := NewSession(NewSocket(c1), &SessionConfig{Client: true, MaxFrameSize: 1024, MaxReceiveBuffer: 4096, AcceptBacklog: 8})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	st, err := sess.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		readDone <- err
+	}()
+
+	// Give the Read call time to actually block, then sever the
+	// connection out from under the
+	// Session, exactly like a dropped TCP connection would.
+	time.Sleep(20 * time.Millisecond)
+	c1.Close()
+
+	select {
+	case err := <-readDone:
+		if err == nil {
+			t.Fatal("Stream.Read returned a nil error after the Session's Socket was closed out from under it")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stream.Read did not unblock after the underlying Socket died (smux issue #68 invariant)")
+	}
+
+	if !sess.IsClosed() {
+		t.Fatal("Session.IsClosed() = false after its Socket died")
+	}
+	if _, err := sess.OpenStream(); err == nil {
+		t.Fatal("OpenStream succeeded on a dead Session")
+	}
+}
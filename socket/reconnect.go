@@ -0,0 +1,251 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ Socket = (*Reconnector)(nil)
+
+// A Dialer creates a replacement net.Conn for a Reconnector to Reset its
+// Socket onto.
+type Dialer func() (net.Conn, error)
+
+// Strategy computes how long to wait before the retries-th reconnection
+// attempt (retries starts at 0 for the first retry after the initial
+// failure), so callers can plug in their own policy (constant,
+// decorrelated-jitter, etc.) in place of the built-in exponential one.
+type Strategy interface {
+	Backoff(retries int) time.Duration
+}
+
+// ExponentialStrategy is the default Strategy: delay = min(base *
+// factor^retries, max), randomized by +/- jitter/2.
+type ExponentialStrategy struct {
+	Base   time.Duration
+	Factor float64
+	Max    time.Duration
+	Jitter float64
+}
+
+// Backoff implements Strategy.
+func (e *ExponentialStrategy) Backoff(retries int) time.Duration {
+	d := float64(e.Base) * math.Pow(e.Factor, float64(retries))
+	if max := float64(e.Max); e.Max > 0 && d > max {
+		d = max
+	}
+	if e.Jitter > 0 {
+		d *= 1 + rand.Float64()*e.Jitter - e.Jitter/2
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// DefaultStrategy returns the Strategy used when ReconnectConfig.Strategy is nil:
+// base=1s, factor=1.6, jitter=0.2, max=120s.
+func DefaultStrategy() Strategy {
+	return &ExponentialStrategy{
+		Base:   time.Second,
+		Factor: 1.6,
+		Max:    120 * time.Second,
+		Jitter: 0.2,
+	}
+}
+
+// ReconnectConfig configures a Reconnector created by NewReconnector.
+type ReconnectConfig struct {
+	// Dial creates the replacement net.Conn for each reconnect attempt.
+	Dial Dialer
+	// Strategy paces reconnect attempts; nil uses DefaultStrategy().
+	Strategy Strategy
+	// RetryWrites allows Write/WritePacket to transparently reconnect and
+	// retry after a transient failure. It defaults to false: a write whose
+	// body may not be idempotent (already partially sent, or side-effecting
+	// on the peer) fails fast instead, and the caller decides whether to
+	// resend. Reads are always safe to retry, since nothing of the caller's
+	// has been consumed yet.
+	RetryWrites bool
+	// OnRetry, if set, is called before each reconnect attempt (attempt
+	// starts at 0) with the failed call's error, or with the last dial error
+	// once a dial has failed; returning false aborts reconnection and the
+	// failed call returns its own original error. It is also the hook
+	// point for logging or rotating a packet id before the retried call.
+	OnRetry func(attempt int, cause error) bool
+}
+
+// A Reconnector wraps a Socket so that a transient network error from
+// Read/Write/ReadPacket/WritePacket transparently re-dials via Dial and
+// calls Reset on the underlying Socket, backing off between attempts
+// according to Strategy.
+type Reconnector struct {
+	Socket
+	protoFunc []ProtoFunc
+	dial      Dialer
+	strategy  Strategy
+	retryW    bool
+	onRetry   func(attempt int, cause error) bool
+
+	mu sync.Mutex
+}
+
+// NewReconnector wraps s so that it reconnects through cfg.Dial on
+// transient errors. protoFunc is applied to each reconnected net.Conn, the
+// same way it would be passed to NewSocket/GetSocket.
+func NewReconnector(s Socket, cfg ReconnectConfig, protoFunc ...ProtoFunc) *Reconnector {
+	strategy := cfg.Strategy
+	if strategy == nil {
+		strategy = DefaultStrategy()
+	}
+	return &Reconnector{
+		Socket:    s,
+		protoFunc: protoFunc,
+		dial:      cfg.Dial,
+		strategy:  strategy,
+		retryW:    cfg.RetryWrites,
+		onRetry:   cfg.OnRetry,
+	}
+}
+
+// Read reads from the Socket, transparently reconnecting and retrying once
+// on a transient network error.
+func (r *Reconnector) Read(b []byte) (int, error) {
+	n, err := r.Socket.Read(b)
+	if err != nil && isTransient(err) && r.reconnect(err) == nil {
+		return r.Socket.Read(b)
+	}
+	return n, err
+}
+
+// Write writes to the Socket. On a transient network error it fails fast
+// unless RetryWrites is set, since the body may not be safe to resend; see
+// ReconnectConfig.RetryWrites.
+func (r *Reconnector) Write(b []byte) (int, error) {
+	n, err := r.Socket.Write(b)
+	if err != nil && r.retryW && isTransient(err) && r.reconnect(err) == nil {
+		return r.Socket.Write(b)
+	}
+	return n, err
+}
+
+// ReadPacket reads a packet from the Socket, transparently reconnecting and
+// retrying once on a transient network error.
+func (r *Reconnector) ReadPacket(packet *Packet) error {
+	err := r.Socket.ReadPacket(packet)
+	if err != nil && isTransient(err) && r.reconnect(err) == nil {
+		return r.Socket.ReadPacket(packet)
+	}
+	return err
+}
+
+// WritePacket writes a packet to the Socket. On a transient network error it
+// fails fast unless RetryWrites is set, since the packet's body may not be
+// idempotent; see ReconnectConfig.RetryWrites.
+func (r *Reconnector) WritePacket(packet *Packet) error {
+	err := r.Socket.WritePacket(packet)
+	if err != nil && r.retryW && isTransient(err) && r.reconnect(err) == nil {
+		return r.Socket.WritePacket(packet)
+	}
+	return err
+}
+
+// ReadPacketContext reads a packet from the Socket with the same
+// reconnect/retry behavior as ReadPacket, but never treats ctx's own
+// cancellation as a reason to reconnect: a caller-scoped context timing out
+// says nothing about whether the underlying connection is actually broken.
+func (r *Reconnector) ReadPacketContext(ctx context.Context, packet *Packet) error {
+	err := r.Socket.ReadPacketContext(ctx, packet)
+	if err != nil && err != ctx.Err() && isTransient(err) && r.reconnect(err) == nil {
+		return r.Socket.ReadPacketContext(ctx, packet)
+	}
+	return err
+}
+
+// WritePacketContext writes a packet to the Socket with the same
+// reconnect/retry behavior as WritePacket (including RetryWrites), but never
+// treats ctx's own cancellation as a reason to reconnect; see
+// ReadPacketContext.
+func (r *Reconnector) WritePacketContext(ctx context.Context, packet *Packet) error {
+	err := r.Socket.WritePacketContext(ctx, packet)
+	if err != nil && r.retryW && err != ctx.Err() && isTransient(err) && r.reconnect(err) == nil {
+		return r.Socket.WritePacketContext(ctx, packet)
+	}
+	return err
+}
+
+// reconnect re-dials and Resets the wrapped Socket, retrying with backoff
+// until it succeeds or OnRetry aborts. It serializes reconnection so
+// concurrent callers that hit the same broken conn don't all dial at once.
+func (r *Reconnector) reconnect(cause error) error {
+	if r.dial == nil {
+		return cause
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if r.onRetry != nil && !r.onRetry(attempt, cause) {
+			return cause
+		}
+		if attempt > 0 {
+			time.Sleep(r.strategy.Backoff(attempt - 1))
+		}
+		conn, err := r.dial()
+		if err != nil {
+			cause = err
+			continue
+		}
+		r.Socket.Reset(conn, r.protoFunc...)
+		return nil
+	}
+}
+
+// isTransient reports whether err looks like a broken connection worth
+// reconnecting over, as opposed to a caller-scoped cancellation.
+// context.Canceled/context.DeadlineExceeded are never transient: they come
+// from a single caller's ReadPacketContext/WritePacketContext deadline or
+// cancellation (see context.go) and say nothing about the health of the
+// connection other callers may still be using.
+//
+// Note this can't fully distinguish a dead connection from an ordinary
+// caller-armed SetReadDeadline idle timeout (socket.go's documented idle
+// timeout pattern): both surface as a plain net.Error with Timeout() true.
+// Callers relying on that idle-timeout pattern over a Reconnector should set
+// RetryWrites deliberately and treat a spurious reconnect as an accepted
+// cost of the pattern, or avoid mixing the two.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok {
+		return ne.Timeout() || ne.Temporary()
+	}
+	return false
+}
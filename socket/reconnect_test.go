@@ -0,0 +1,256 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package socket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+)
+
+func TestExponentialStrategyBackoffGrowsAndClamps(t *testing.T) {
+	s := &ExponentialStrategy{Base: time.Second, Factor: 2, Max: 10 * time.Second}
+	if got := s.Backoff(0); got != time.Second {
+		t.Fatalf("Backoff(0) = %v, want 1s", got)
+	}
+	if got := s.Backoff(1); got != 2*time.Second {
+		t.Fatalf("Backoff(1) = %v, want 2s", got)
+	}
+	if got := s.Backoff(2); got != 4*time.Second {
+		t.Fatalf("Backoff(2) = %v, want 4s", got)
+	}
+	if got := s.Backoff(10); got != 10*time.Second {
+		t.Fatalf("Backoff(10) = %v, want clamped to Max 10s", got)
+	}
+}
+
+func TestExponentialStrategyBackoffJitterBounded(t *testing.T) {
+	s := &ExponentialStrategy{Base: time.Second, Factor: 1, Max: time.Minute, Jitter: 0.2}
+	base := float64(time.Second)
+	lo, hi := base*0.9, base*1.1 // delay*(1 + jitter*rand - jitter/2) with jitter=0.2 ranges over [-10%,+10%]
+	for i := 0; i < 200; i++ {
+		d := float64(s.Backoff(0))
+		if d < lo || d > hi {
+			t.Fatalf("Backoff() = %v, want within [%v,%v]", time.Duration(d), time.Duration(lo), time.Duration(hi))
+		}
+	}
+}
+
+func TestExponentialStrategyBackoffNeverNegative(t *testing.T) {
+	s := &ExponentialStrategy{Base: time.Millisecond, Factor: 1, Jitter: 2} // deliberately oversized jitter
+	for i := 0; i < 200; i++ {
+		if s.Backoff(0) < 0 {
+			t.Fatal("Backoff() returned a negative duration")
+		}
+	}
+}
+
+func TestDefaultStrategy(t *testing.T) {
+	s, ok := DefaultStrategy().(*ExponentialStrategy)
+	if !ok {
+		t.Fatalf("DefaultStrategy() = %T, want *ExponentialStrategy", DefaultStrategy())
+	}
+	if s.Base != time.Second || s.Factor != 1.6 || s.Max != 120*time.Second || s.Jitter != 0.2 {
+		t.Fatalf("DefaultStrategy() = %+v, want base=1s factor=1.6 max=120s jitter=0.2", s)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"EOF", io.EOF, true},
+		{"ErrUnexpectedEOF", io.ErrUnexpectedEOF, true},
+		{"context.Canceled", context.Canceled, false},
+		{"context.DeadlineExceeded", context.DeadlineExceeded, false},
+		{"plain error", errors.New("boom"), false},
+		{"net timeout", errTimeout, true},
+	}
+	for _, c := range cases {
+		if got := isTransient(c.err); got != c.want {
+			t.Errorf("isTransient(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// errBroken is a net.Error with Timeout() true, so isTransient treats it as
+// a broken connection worth reconnecting over.
+var errBroken error = brokenError{}
+
+type brokenError struct{}
+
+func (brokenError) Error() string   { return "fakeSocket: broken" }
+func (brokenError) Timeout() bool   { return true }
+func (brokenError) Temporary() bool { return true }
+
+// fakeSocket is a minimal Socket test double whose Read/Write/ReadPacket/
+// WritePacket fail with errBroken until Reset is called, so it can stand in
+// for a connection a Reconnector dials back to health.
+type fakeSocket struct {
+	mu         sync.Mutex
+	broken     bool
+	resetCount int
+}
+
+var _ Socket = (*fakeSocket)(nil)
+
+func (f *fakeSocket) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		return 0, errBroken
+	}
+	return len(b), nil
+}
+
+func (f *fakeSocket) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		return 0, errBroken
+	}
+	return len(b), nil
+}
+
+func (f *fakeSocket) ReadPacket(packet *Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		return errBroken
+	}
+	return nil
+}
+
+func (f *fakeSocket) WritePacket(packet *Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		return errBroken
+	}
+	return nil
+}
+
+func (f *fakeSocket) ReadPacketContext(ctx context.Context, packet *Packet) error {
+	return f.ReadPacket(packet)
+}
+
+func (f *fakeSocket) WritePacketContext(ctx context.Context, packet *Packet) error {
+	return f.WritePacket(packet)
+}
+
+func (f *fakeSocket) Reset(netConn net.Conn, protoFunc ...ProtoFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.broken = false
+	f.resetCount++
+}
+
+func (f *fakeSocket) LocalAddr() net.Addr                { return nil }
+func (f *fakeSocket) RemoteAddr() net.Addr               { return nil }
+func (f *fakeSocket) SetDeadline(t time.Time) error      { return nil }
+func (f *fakeSocket) SetReadDeadline(t time.Time) error  { return nil }
+func (f *fakeSocket) SetWriteDeadline(t time.Time) error { return nil }
+func (f *fakeSocket) Close() error                       { return nil }
+func (f *fakeSocket) Public() goutil.Map                 { return nil }
+func (f *fakeSocket) PublicLen() int                     { return 0 }
+func (f *fakeSocket) Stats() SocketStats                 { return SocketStats{} }
+func (f *fakeSocket) Id() string                         { return "fake" }
+func (f *fakeSocket) SetId(string)                       {}
+
+// pipeDialer returns a Dialer that hands out a fresh net.Pipe conn on every
+// call, closing the peer ends on cleanup; good enough for a Reconnector test
+// since fakeSocket.Reset never actually reads/writes the dialed net.Conn.
+func pipeDialer(t *testing.T) Dialer {
+	return func() (net.Conn, error) {
+		c, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		return c, nil
+	}
+}
+
+func TestReconnectorRetriesAfterReconnect(t *testing.T) {
+	fs := &fakeSocket{broken: true}
+	r := NewReconnector(fs, ReconnectConfig{Dial: pipeDialer(t)})
+
+	n, err := r.Read(make([]byte, 4))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("Read() n = %d, want 4", n)
+	}
+	if fs.resetCount != 1 {
+		t.Fatalf("resetCount = %d, want 1", fs.resetCount)
+	}
+}
+
+func TestReconnectorOnRetryAbortSurfacesOriginalError(t *testing.T) {
+	fs := &fakeSocket{broken: true}
+	r := NewReconnector(fs, ReconnectConfig{
+		Dial: pipeDialer(t),
+		OnRetry: func(attempt int, cause error) bool {
+			return false
+		},
+	})
+
+	_, err := r.Read(make([]byte, 4))
+	if err != errBroken {
+		t.Fatalf("Read() err = %v, want errBroken (OnRetry=false must abort and surface the original cause)", err)
+	}
+	if fs.resetCount != 0 {
+		t.Fatalf("resetCount = %d, want 0 (OnRetry=false must not dial)", fs.resetCount)
+	}
+}
+
+func TestReconnectorRetryWritesFalseFailsFast(t *testing.T) {
+	fs := &fakeSocket{broken: true}
+	r := NewReconnector(fs, ReconnectConfig{Dial: pipeDialer(t)}) // RetryWrites defaults to false
+
+	if _, err := r.Write(make([]byte, 4)); err != errBroken {
+		t.Fatalf("Write() err = %v, want errBroken", err)
+	}
+	if err := r.WritePacket(new(Packet)); err != errBroken {
+		t.Fatalf("WritePacket() err = %v, want errBroken", err)
+	}
+	if fs.resetCount != 0 {
+		t.Fatalf("resetCount = %d, want 0 (RetryWrites=false must not dial)", fs.resetCount)
+	}
+}
+
+func TestReconnectorRetryWritesTrueReconnectsAndRetries(t *testing.T) {
+	fs := &fakeSocket{broken: true}
+	r := NewReconnector(fs, ReconnectConfig{Dial: pipeDialer(t), RetryWrites: true})
+
+	n, err := r.Write(make([]byte, 4))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("Write() n = %d, want 4", n)
+	}
+	if fs.resetCount != 1 {
+		t.Fatalf("resetCount = %d, want 1", fs.resetCount)
+	}
+}
@@ -0,0 +1,603 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrylee2cn/goutil/errors"
+)
+
+// A Session multiplexes many logical Streams over a single Socket, in the
+// style of xtaci/smux, so higher levels of teleport can dispatch calls and
+// pushes on parallel streams without a large body on one stream blocking
+// every other one (head-of-line blocking).
+//
+// Multiple goroutines may invoke methods on a Session simultaneously.
+type Session struct {
+	conn      Socket
+	config    *SessionConfig
+	protoFunc []ProtoFunc
+
+	nextStreamID uint32 // atomic
+
+	streamLock sync.Mutex
+	streams    map[uint32]*Stream
+
+	acceptCh chan *Stream
+
+	writeLock  sync.Mutex
+	writeCond  *sync.Cond
+	writeQueue writeQueue
+	seq        uint64
+	bucket     *tokenBucket
+
+	lastActive int64 // unix nano, atomic
+
+	dieOnce sync.Once
+	dieCh   chan struct{}
+	dieErr  atomic.Value // errBox
+}
+
+// SessionConfig configures a Session created by NewSession.
+type SessionConfig struct {
+	// Client marks this side as the stream-opening (dialing) side, which
+	// allocates odd stream IDs; the other side must leave this false so it
+	// allocates even ones and the two sides never collide.
+	Client bool
+	// KeepAliveInterval is how often a NOP frame is sent to detect a dead peer.
+	// A zero value disables the keepalive goroutine.
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout is how long the Session waits without receiving any
+	// frame from the peer before treating the connection as dead.
+	KeepAliveTimeout time.Duration
+	// MaxFrameSize is the largest PSH payload written per frame; larger
+	// Writes are split into multiple frames. The frame header's length field
+	// is a uint16, so a value above maxFrameLength (65535), or <= 0, falls
+	// back to DefaultSessionConfig's.
+	MaxFrameSize int
+	// MaxReceiveBuffer bounds the per-stream receive window: the amount of
+	// unread data one Stream may have buffered before its sender must wait
+	// for a WIN credit update. It also seeds every new Stream's initial
+	// sendWindow, so a value <= 0 falls back to DefaultSessionConfig's instead
+	// of permanently deadlocking every Write (no bytes could ever be read to
+	// earn the first WIN credit).
+	MaxReceiveBuffer int
+	// AcceptBacklog bounds the number of SYN'd streams waiting for AcceptStream;
+	// once full, new SYNs are refused with an immediate FIN.
+	AcceptBacklog int
+	// MaxWriteBytesPerSec throttles the Session's aggregate write rate over
+	// the underlying Socket; zero disables throttling.
+	MaxWriteBytesPerSec int
+}
+
+// DefaultSessionConfig returns the SessionConfig used when NewSession is
+// called with a nil config.
+func DefaultSessionConfig() *SessionConfig {
+	return &SessionConfig{
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveTimeout:  30 * time.Second,
+		MaxFrameSize:      32 * 1024,
+		MaxReceiveBuffer:  256 * 1024,
+		AcceptBacklog:     1024,
+	}
+}
+
+// ErrSessionClosed indicates the Session has been closed, locally or because
+// the underlying Socket failed.
+var ErrSessionClosed = errors.New("socket: session closed")
+
+// ErrKeepAliveTimeout indicates no frame was received from the peer within
+// the configured keepalive timeout.
+var ErrKeepAliveTimeout = errors.New("socket: keepalive timeout")
+
+type errBox struct{ err error }
+
+// maxFrameLength is the largest PSH payload a frame can carry: the wire
+// header's length field (see rawHeader) is a uint16.
+const maxFrameLength = 1<<16 - 1
+
+// sanitizeConfig returns a corrected copy of cfg (or DefaultSessionConfig()
+// if cfg is nil) with out-of-range fields replaced by their default, so a
+// misconfigured MaxFrameSize can't silently truncate the encoded frame
+// length, a zero MaxReceiveBuffer can't leave every new Stream's initial
+// sendWindow at 0, permanently deadlocking Write, and a negative
+// AcceptBacklog can't make the acceptCh make(chan, n) call in NewSession
+// panic with "makechan: size out of range".
+func sanitizeConfig(cfg *SessionConfig) *SessionConfig {
+	def := DefaultSessionConfig()
+	if cfg == nil {
+		return def
+	}
+	clone := *cfg
+	if clone.MaxFrameSize <= 0 || clone.MaxFrameSize > maxFrameLength {
+		clone.MaxFrameSize = def.MaxFrameSize
+	}
+	if clone.MaxReceiveBuffer <= 0 {
+		clone.MaxReceiveBuffer = def.MaxReceiveBuffer
+	}
+	if clone.AcceptBacklog < 0 {
+		clone.AcceptBacklog = def.AcceptBacklog
+	}
+	return &clone
+}
+
+// NewSession wraps Socket s so that it can carry many independent Streams.
+// The protoFuncs, if any, are used to build the Socket view returned by each
+// Stream's WritePacket/ReadPacket, the same way NewSocket/GetSocket let
+// callers opt a connection in to a particular wire protocol.
+//
+// NewSession takes ownership of s: it must not be used directly afterwards.
+func NewSession(s Socket, cfg *SessionConfig, protoFunc ...ProtoFunc) (*Session, error) {
+	if s == nil {
+		return nil, errors.New("socket: NewSession requires a non-nil Socket")
+	}
+	cfg = sanitizeConfig(cfg)
+	sess := &Session{
+		conn:      s,
+		config:    cfg,
+		protoFunc: protoFunc,
+		streams:   make(map[uint32]*Stream),
+		acceptCh:  make(chan *Stream, cfg.AcceptBacklog),
+		dieCh:     make(chan struct{}),
+		bucket:    newTokenBucket(cfg.MaxWriteBytesPerSec),
+	}
+	if cfg.Client {
+		sess.nextStreamID = 1
+	}
+	sess.writeCond = sync.NewCond(&sess.writeLock)
+	heap.Init(&sess.writeQueue)
+	sess.touch()
+	go sess.recvLoop()
+	go sess.sendLoop()
+	go sess.keepaliveLoop()
+	return sess, nil
+}
+
+// OpenStream opens a new Stream on the Session.
+func (sess *Session) OpenStream() (*Stream, error) {
+	if sess.IsClosed() {
+		return nil, sess.dieError()
+	}
+	id := atomic.AddUint32(&sess.nextStreamID, 2) - 2
+	st := newStream(id, sess)
+
+	sess.streamLock.Lock()
+	if sess.streams == nil {
+		sess.streamLock.Unlock()
+		return nil, sess.dieError()
+	}
+	sess.streams[id] = st
+	sess.streamLock.Unlock()
+
+	if err := sess.writeFrame(newFrame(cmdSYN, id), prioCtrl); err != nil {
+		sess.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream blocks until a Stream opened by the peer is available, or the
+// Session is closed.
+func (sess *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-sess.acceptCh:
+		return st, nil
+	case <-sess.dieCh:
+		return nil, sess.dieError()
+	}
+}
+
+// NumStreams returns the number of currently open streams.
+func (sess *Session) NumStreams() int {
+	sess.streamLock.Lock()
+	n := len(sess.streams)
+	sess.streamLock.Unlock()
+	return n
+}
+
+// IsClosed reports whether the Session has been closed.
+func (sess *Session) IsClosed() bool {
+	select {
+	case <-sess.dieCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the Session and its underlying Socket, tearing down every
+// open Stream.
+func (sess *Session) Close() error {
+	sess.fail(ErrSessionClosed)
+	return nil
+}
+
+// fail is the single teardown path: it is used both for a voluntary Close
+// and for an unrecoverable I/O error from recvLoop/sendLoop. Per smux issue
+// #68, when the background writer/reader errors out we must unblock every
+// pending write AND close the underlying Socket, or leaked streams can
+// block forever.
+func (sess *Session) fail(err error) {
+	sess.dieOnce.Do(func() {
+		sess.dieErr.Store(errBox{err})
+		close(sess.dieCh)
+
+		sess.writeLock.Lock()
+		for sess.writeQueue.Len() > 0 {
+			req := heap.Pop(&sess.writeQueue).(*writeRequest)
+			req.result <- err
+		}
+		sess.writeCond.Broadcast()
+		sess.writeLock.Unlock()
+
+		sess.streamLock.Lock()
+		for _, st := range sess.streams {
+			st.closeWithError(err)
+		}
+		sess.streams = nil
+		sess.streamLock.Unlock()
+
+		sess.conn.Close()
+	})
+}
+
+func (sess *Session) dieError() error {
+	if v, ok := sess.dieErr.Load().(errBox); ok {
+		return v.err
+	}
+	return ErrSessionClosed
+}
+
+func (sess *Session) removeStream(id uint32) {
+	sess.streamLock.Lock()
+	if sess.streams != nil {
+		delete(sess.streams, id)
+	}
+	sess.streamLock.Unlock()
+}
+
+func (sess *Session) touch() {
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+}
+
+func (sess *Session) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sess.lastActive))
+}
+
+// recvLoop is the sole reader of the underlying Socket; it decodes frames
+// and dispatches them to the addressed Stream (or, for SYN, to acceptCh).
+func (sess *Session) recvLoop() {
+	var hdr rawHeader
+	for {
+		if _, err := io.ReadFull(sess.conn, hdr[:]); err != nil {
+			sess.fail(err)
+			return
+		}
+		if hdr.Version() != version1 {
+			sess.fail(errors.New("socket: unsupported mux frame version"))
+			return
+		}
+		sess.touch()
+		sid := hdr.StreamID()
+		switch hdr.Cmd() {
+		case cmdSYN:
+			sess.handleSYN(sid)
+		case cmdFIN:
+			sess.handleFIN(sid)
+		case cmdNOP:
+			// keepalive only: touch() above already recorded the activity.
+		case cmdWIN:
+			var buf [4]byte
+			if _, err := io.ReadFull(sess.conn, buf[:]); err != nil {
+				sess.fail(err)
+				return
+			}
+			sess.handleWIN(sid, binary.LittleEndian.Uint32(buf[:]))
+		case cmdPSH:
+			length := hdr.Length()
+			var body []byte
+			if length > 0 {
+				body = make([]byte, length)
+				if _, err := io.ReadFull(sess.conn, body); err != nil {
+					sess.fail(err)
+					return
+				}
+			}
+			sess.handlePSH(sid, body)
+		default:
+			sess.fail(errors.New("socket: unknown mux frame command"))
+			return
+		}
+	}
+}
+
+func (sess *Session) handleSYN(sid uint32) {
+	sess.streamLock.Lock()
+	if sess.streams == nil {
+		sess.streamLock.Unlock()
+		return
+	}
+	if _, ok := sess.streams[sid]; ok {
+		sess.streamLock.Unlock()
+		return
+	}
+	st := newStream(sid, sess)
+	sess.streams[sid] = st
+	sess.streamLock.Unlock()
+
+	select {
+	case sess.acceptCh <- st:
+	default:
+		// Accept backlog is full: refuse the stream rather than block recvLoop.
+		sess.removeStream(sid)
+		sess.writeFrame(newFrame(cmdFIN, sid), prioCtrl)
+	}
+}
+
+func (sess *Session) handleFIN(sid uint32) {
+	st := sess.getStream(sid)
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (sess *Session) handleWIN(sid uint32, delta uint32) {
+	st := sess.getStream(sid)
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.sendWindow += int32(delta)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (sess *Session) handlePSH(sid uint32, data []byte) {
+	st := sess.getStream(sid)
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.recvBuf.Write(data)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (sess *Session) getStream(sid uint32) *Stream {
+	sess.streamLock.Lock()
+	st := sess.streams[sid]
+	sess.streamLock.Unlock()
+	return st
+}
+
+// keepaliveLoop periodically sends a NOP and closes the Session if the peer
+// has gone silent for longer than KeepAliveTimeout.
+func (sess *Session) keepaliveLoop() {
+	if sess.config.KeepAliveInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(sess.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if sess.config.KeepAliveTimeout > 0 &&
+				time.Since(sess.lastActiveTime()) > sess.config.KeepAliveTimeout {
+				sess.fail(ErrKeepAliveTimeout)
+				return
+			}
+			sess.writeFrame(newFrame(cmdNOP, 0), prioCtrl)
+		case <-sess.dieCh:
+			return
+		}
+	}
+}
+
+// writeFrame enqueues f on the priority write queue and blocks until
+// sendLoop has actually written it (or the Session dies), so control frames
+// (SYN/FIN/NOP/WIN) can jump ahead of queued data frames without the caller
+// needing to know about the queue.
+func (sess *Session) writeFrame(f frame, prio int) error {
+	req := &writeRequest{frame: f, prio: prio, result: make(chan error, 1)}
+	sess.writeLock.Lock()
+	sess.seq++
+	req.seq = sess.seq
+	heap.Push(&sess.writeQueue, req)
+	sess.writeCond.Signal()
+	sess.writeLock.Unlock()
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-sess.dieCh:
+		return sess.dieError()
+	}
+}
+
+// sendLoop is the sole writer of the underlying Socket, draining the
+// priority write queue so control frames are never starved by a backlog of
+// large data frames.
+func (sess *Session) sendLoop() {
+	for {
+		sess.writeLock.Lock()
+		for sess.writeQueue.Len() == 0 {
+			select {
+			case <-sess.dieCh:
+				sess.writeLock.Unlock()
+				return
+			default:
+			}
+			sess.writeCond.Wait()
+		}
+		req := heap.Pop(&sess.writeQueue).(*writeRequest)
+		sess.writeLock.Unlock()
+
+		hdr := req.frame.encodeHeader()
+		sess.bucket.take(headerSize + len(req.frame.data))
+
+		_, err := sess.conn.Write(hdr[:])
+		if err == nil && len(req.frame.data) > 0 {
+			_, err = sess.conn.Write(req.frame.data)
+		}
+		req.result <- err
+		if err != nil {
+			sess.fail(err)
+			return
+		}
+	}
+}
+
+// Frame priorities: control frames (SYN/FIN/NOP/WIN) always jump ahead of
+// queued data (PSH) frames, regardless of arrival order.
+const (
+	prioData int = 0
+	prioCtrl int = 1
+)
+
+const version1 byte = 1
+
+type cmdType byte
+
+const (
+	cmdSYN cmdType = iota // open a new stream
+	cmdFIN                // half-close a stream (remote write side)
+	cmdPSH                // data
+	cmdNOP                // keepalive, no payload
+	cmdWIN                // receive-window credit update, uint32 payload
+)
+
+// headerSize is the wire size of a frame header: {ver:1, cmd:1, length:2, streamID:4}.
+const headerSize = 8
+
+type rawHeader [headerSize]byte
+
+func (h rawHeader) Version() byte    { return h[0] }
+func (h rawHeader) Cmd() cmdType     { return cmdType(h[1]) }
+func (h rawHeader) Length() uint16   { return binary.LittleEndian.Uint16(h[2:4]) }
+func (h rawHeader) StreamID() uint32 { return binary.LittleEndian.Uint32(h[4:8]) }
+
+type frame struct {
+	ver  byte
+	cmd  cmdType
+	sid  uint32
+	data []byte
+}
+
+func newFrame(cmd cmdType, sid uint32) frame {
+	return frame{ver: version1, cmd: cmd, sid: sid}
+}
+
+func (f *frame) encodeHeader() rawHeader {
+	var h rawHeader
+	h[0] = f.ver
+	h[1] = byte(f.cmd)
+	binary.LittleEndian.PutUint16(h[2:4], uint16(len(f.data)))
+	binary.LittleEndian.PutUint32(h[4:8], f.sid)
+	return h
+}
+
+// writeRequest is one entry of the priority write queue: control frames
+// (higher prio) are always popped before data frames, and ties break FIFO
+// on seq.
+type writeRequest struct {
+	frame  frame
+	seq    uint64
+	prio   int
+	result chan error
+}
+
+// writeQueue is a container/heap priority queue ordered by (prio, seq).
+type writeQueue []*writeRequest
+
+func (q writeQueue) Len() int { return len(q) }
+
+func (q writeQueue) Less(i, j int) bool {
+	if q[i].prio != q[j].prio {
+		return q[i].prio > q[j].prio
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q writeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *writeQueue) Push(x interface{}) {
+	*q = append(*q, x.(*writeRequest))
+}
+
+func (q *writeQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// tokenBucket throttles the Session's aggregate write rate; a nil
+// *tokenBucket (MaxWriteBytesPerSec == 0) imposes no throttling.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64 // bytes per second
+	last     time.Time
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		tokens:   float64(bytesPerSec),
+		capacity: float64(bytesPerSec),
+		rate:     float64(bytesPerSec),
+		last:     time.Now(),
+	}
+}
+
+func (b *tokenBucket) take(n int) {
+	if b == nil {
+		return
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return
+		}
+		wait := time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
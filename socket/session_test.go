@@ -0,0 +1,120 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"container/heap"
+	"testing"
+	"time"
+)
+
+func TestRawHeaderEncodeDecode(t *testing.T) {
+	f := newFrame(cmdPSH, 42)
+	f.data = []byte("hello")
+	hdr := f.encodeHeader()
+	if hdr.Version() != version1 {
+		t.Fatalf("Version() = %d, want %d", hdr.Version(), version1)
+	}
+	if hdr.Cmd() != cmdPSH {
+		t.Fatalf("Cmd() = %d, want %d", hdr.Cmd(), cmdPSH)
+	}
+	if hdr.Length() != uint16(len(f.data)) {
+		t.Fatalf("Length() = %d, want %d", hdr.Length(), len(f.data))
+	}
+	if hdr.StreamID() != 42 {
+		t.Fatalf("StreamID() = %d, want 42", hdr.StreamID())
+	}
+}
+
+func TestWriteQueueOrdering(t *testing.T) {
+	var q writeQueue
+	heap.Init(&q)
+	heap.Push(&q, &writeRequest{seq: 1, prio: prioData})
+	heap.Push(&q, &writeRequest{seq: 2, prio: prioData})
+	heap.Push(&q, &writeRequest{seq: 3, prio: prioCtrl})
+	heap.Push(&q, &writeRequest{seq: 4, prio: prioData})
+
+	var order []uint64
+	for q.Len() > 0 {
+		order = append(order, heap.Pop(&q).(*writeRequest).seq)
+	}
+	want := []uint64{3, 1, 2, 4} // control (seq 3) jumps the data backlog; data stays FIFO
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestTokenBucketThrottles(t *testing.T) {
+	b := newTokenBucket(100) // 100 bytes/sec
+	start := time.Now()
+	b.take(100) // drains the initial burst immediately
+	b.take(50)  // must wait roughly 0.5s for a refill
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("take(50) after exhausting the burst returned too fast: %v", elapsed)
+	}
+}
+
+func TestNilTokenBucketDoesNotThrottle(t *testing.T) {
+	var b *tokenBucket
+	done := make(chan struct{})
+	go func() {
+		b.take(1 << 30)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("nil tokenBucket.take blocked, want a no-op")
+	}
+}
+
+func TestSanitizeConfigClampsMaxFrameSize(t *testing.T) {
+	cfg := sanitizeConfig(&SessionConfig{MaxFrameSize: maxFrameLength + 1})
+	if want := DefaultSessionConfig().MaxFrameSize; cfg.MaxFrameSize != want {
+		t.Fatalf("MaxFrameSize = %d, want %d", cfg.MaxFrameSize, want)
+	}
+}
+
+func TestSanitizeConfigGuardsZeroMaxReceiveBuffer(t *testing.T) {
+	cfg := sanitizeConfig(&SessionConfig{Client: true})
+	if want := DefaultSessionConfig().MaxReceiveBuffer; cfg.MaxReceiveBuffer != want {
+		t.Fatalf("MaxReceiveBuffer = %d, want %d", cfg.MaxReceiveBuffer, want)
+	}
+	if !cfg.Client {
+		t.Fatal("sanitizeConfig must not discard the caller's other fields")
+	}
+}
+
+func TestSanitizeConfigClampsNegativeAcceptBacklog(t *testing.T) {
+	cfg := sanitizeConfig(&SessionConfig{AcceptBacklog: -1})
+	if want := DefaultSessionConfig().AcceptBacklog; cfg.AcceptBacklog != want {
+		t.Fatalf("AcceptBacklog = %d, want %d", cfg.AcceptBacklog, want)
+	}
+}
+
+func TestSanitizeConfigNilUsesDefault(t *testing.T) {
+	cfg := sanitizeConfig(nil)
+	def := DefaultSessionConfig()
+	if *cfg != *def {
+		t.Fatalf("sanitizeConfig(nil) = %+v, want %+v", cfg, def)
+	}
+}
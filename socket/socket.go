@@ -17,6 +17,7 @@
 package socket
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -76,6 +77,20 @@ type (
 		// Note: must be safe for concurrent use by multiple goroutines.
 		ReadPacket(packet *Packet) error
 
+		// WritePacketContext writes header and body to the connection,
+		// aborting as soon as ctx is done. Unlike arming a deadline directly,
+		// this composes correctly when multiple goroutines share the Socket:
+		// it never clobbers a deadline another goroutine may be relying on.
+		// If ctx is canceled, it returns ctx.Err() rather than a timeout error.
+		WritePacketContext(ctx context.Context, packet *Packet) error
+
+		// ReadPacketContext reads header and body from the connection,
+		// aborting as soon as ctx is done. Unlike arming a deadline directly,
+		// this composes correctly when multiple goroutines share the Socket:
+		// it never clobbers a deadline another goroutine may be relying on.
+		// If ctx is canceled, it returns ctx.Err() rather than a timeout error.
+		ReadPacketContext(ctx context.Context, packet *Packet) error
+
 		// Read reads data from the connection.
 		// Read can be made to time out and return an Error with Timeout() == true
 		// after a fixed time limit; see SetDeadline and SetReadDeadline.
@@ -97,6 +112,9 @@ type (
 		Public() goutil.Map
 		// PublicLen returns the length of public data of Socket.
 		PublicLen() int
+		// Stats returns a snapshot of the socket's activity counters and
+		// buffer state, for production introspection; see also Walk.
+		Stats() SocketStats
 		// Id returns the socket id.
 		Id() string
 		// SetId sets the socket id.
@@ -106,13 +124,16 @@ type (
 	}
 	socket struct {
 		net.Conn
-		protocol  Proto
-		id        string
-		idMutex   sync.RWMutex
-		ctxPublic goutil.Map
-		mu        sync.RWMutex
-		curState  int32
-		fromPool  bool
+		protocol      Proto
+		id            string
+		idMutex       sync.RWMutex
+		ctxPublic     goutil.Map
+		mu            sync.RWMutex
+		curState      int32
+		fromPool      bool
+		readDeadline  time.Time
+		writeDeadline time.Time
+		stats         socketStats
 	}
 )
 
@@ -148,10 +169,15 @@ func NewSocket(c net.Conn, protoFunc ...ProtoFunc) Socket {
 
 func newSocket(c net.Conn, protoFuncs []ProtoFunc) *socket {
 	var s = &socket{
-		protocol: getProto(protoFuncs, c),
-		Conn:     c,
+		Conn: c,
 	}
+	// Bind the protocol to s, not to the raw net.Conn: Pack/Unpack must go
+	// through s.Write/s.Read so the activity counters behind Stats() see
+	// every byte WritePacket/ReadPacket move, not just direct Read/Write calls.
+	s.protocol = getProto(protoFuncs, s)
+	s.stats.touchCreated()
 	s.optimize()
+	register(s)
 	return s
 }
 
@@ -169,8 +195,13 @@ func (s *socket) WritePacket(packet *Packet) error {
 		packet.SetBodyCodec(defaultBodyCodec.Id())
 	}
 	err := protocol.Pack(packet)
-	if err != nil && s.isActiveClosed() {
-		err = ErrProactivelyCloseSocket
+	if err != nil {
+		if s.isActiveClosed() {
+			err = ErrProactivelyCloseSocket
+		}
+		s.stats.addWriteErrors(1)
+	} else {
+		s.stats.addPacketsWritten(1)
 	}
 	return err
 }
@@ -183,7 +214,13 @@ func (s *socket) ReadPacket(packet *Packet) error {
 	s.mu.RLock()
 	protocol := s.protocol
 	s.mu.RUnlock()
-	return protocol.Unpack(packet)
+	err := protocol.Unpack(packet)
+	if err != nil {
+		s.stats.addReadErrors(1)
+	} else {
+		s.stats.addPacketsRead(1)
+	}
+	return err
 }
 
 // Public returns temporary public data of Socket.
@@ -229,7 +266,11 @@ func (s *socket) Reset(netConn net.Conn, protoFunc ...ProtoFunc) {
 	s.mu.Lock()
 	s.Conn = netConn
 	s.SetId("")
-	s.protocol = getProto(protoFunc, netConn)
+	// Bind to s, not netConn directly; see newSocket.
+	s.protocol = getProto(protoFunc, s)
+	s.readDeadline = time.Time{}
+	s.writeDeadline = time.Time{}
+	s.stats.reset()
 	atomic.StoreInt32(&s.curState, normal)
 	s.optimize()
 	s.mu.Unlock()
@@ -258,6 +299,8 @@ func (s *socket) Close() error {
 		s.ctxPublic = nil
 		s.protocol = nil
 		socketPool.Put(s)
+	} else {
+		deregister(s)
 	}
 	return err
 }
@@ -267,7 +310,10 @@ func (s *socket) isActiveClosed() bool {
 }
 
 func (s *socket) optimize() {
-	if c, ok := s.Conn.(ifaceSetKeepAlive); ok {
+	// Unwrap transport wrappers (e.g. *tls.Conn, an HTTP-CONNECT
+	// bufferedConn) so TCP-level tuning still reaches the real *net.TCPConn.
+	conn := underlyingConn(s.Conn)
+	if c, ok := conn.(ifaceSetKeepAlive); ok {
 		if changeKeepAlive {
 			c.SetKeepAlive(keepAlive)
 		}
@@ -275,7 +321,7 @@ func (s *socket) optimize() {
 			c.SetKeepAlivePeriod(keepAlivePeriod)
 		}
 	}
-	if c, ok := s.Conn.(ifaceSetBuffer); ok {
+	if c, ok := conn.(ifaceSetBuffer); ok {
 		if readBuffer >= 0 {
 			c.SetReadBuffer(readBuffer)
 		}
@@ -0,0 +1,159 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SocketStats is a point-in-time snapshot of a Socket's activity, returned
+// by Socket.Stats() and usable together with Walk to answer, in production,
+// how many sockets are open, which are idle, and which are stuck writing --
+// mirroring gRPC's channelz design.
+type SocketStats struct {
+	BytesRead       uint64
+	BytesWritten    uint64
+	PacketsRead     uint64
+	PacketsWritten  uint64
+	ReadErrors      uint64
+	WriteErrors     uint64
+	LastActive      time.Time
+	CreatedAt       time.Time
+	ReadBufferSize  int
+	WriteBufferSize int
+	KeepAlive       bool
+}
+
+// socketStats holds the atomically-updated counters backing Socket.Stats().
+type socketStats struct {
+	bytesRead      uint64
+	bytesWritten   uint64
+	packetsRead    uint64
+	packetsWritten uint64
+	readErrors     uint64
+	writeErrors    uint64
+	lastActive     int64 // unix nano, atomic
+	createdAt      int64 // unix nano, atomic
+}
+
+func (st *socketStats) touchCreated() {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&st.createdAt, now)
+	atomic.StoreInt64(&st.lastActive, now)
+}
+
+// reset clears the counters and re-stamps createdAt, since Reset wraps a
+// pooled *socket around a brand new net.Conn.
+func (st *socketStats) reset() {
+	atomic.StoreUint64(&st.bytesRead, 0)
+	atomic.StoreUint64(&st.bytesWritten, 0)
+	atomic.StoreUint64(&st.packetsRead, 0)
+	atomic.StoreUint64(&st.packetsWritten, 0)
+	atomic.StoreUint64(&st.readErrors, 0)
+	atomic.StoreUint64(&st.writeErrors, 0)
+	st.touchCreated()
+}
+
+func (st *socketStats) touchActive() {
+	atomic.StoreInt64(&st.lastActive, time.Now().UnixNano())
+}
+
+func (st *socketStats) addBytesRead(n uint64)      { atomic.AddUint64(&st.bytesRead, n) }
+func (st *socketStats) addBytesWritten(n uint64)   { atomic.AddUint64(&st.bytesWritten, n) }
+func (st *socketStats) addPacketsRead(n uint64)    { atomic.AddUint64(&st.packetsRead, n) }
+func (st *socketStats) addPacketsWritten(n uint64) { atomic.AddUint64(&st.packetsWritten, n) }
+func (st *socketStats) addReadErrors(n uint64)     { atomic.AddUint64(&st.readErrors, n) }
+func (st *socketStats) addWriteErrors(n uint64)    { atomic.AddUint64(&st.writeErrors, n) }
+
+func (st *socketStats) snapshot() SocketStats {
+	return SocketStats{
+		BytesRead:      atomic.LoadUint64(&st.bytesRead),
+		BytesWritten:   atomic.LoadUint64(&st.bytesWritten),
+		PacketsRead:    atomic.LoadUint64(&st.packetsRead),
+		PacketsWritten: atomic.LoadUint64(&st.packetsWritten),
+		ReadErrors:     atomic.LoadUint64(&st.readErrors),
+		WriteErrors:    atomic.LoadUint64(&st.writeErrors),
+		LastActive:     unixNanoTime(atomic.LoadInt64(&st.lastActive)),
+		CreatedAt:      unixNanoTime(atomic.LoadInt64(&st.createdAt)),
+	}
+}
+
+func unixNanoTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+// Read reads data from the connection, recording it in the socket's Stats().
+func (s *socket) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	if n > 0 {
+		s.stats.addBytesRead(uint64(n))
+		s.stats.touchActive()
+	}
+	if err != nil {
+		s.stats.addReadErrors(1)
+	}
+	return n, err
+}
+
+// Write writes data to the connection, recording it in the socket's Stats().
+func (s *socket) Write(b []byte) (int, error) {
+	n, err := s.Conn.Write(b)
+	if n > 0 {
+		s.stats.addBytesWritten(uint64(n))
+		s.stats.touchActive()
+	}
+	if err != nil {
+		s.stats.addWriteErrors(1)
+	}
+	return n, err
+}
+
+// Stats returns a snapshot of the socket's activity counters and buffer
+// state, atomically updated inside Read/Write/ReadPacket/WritePacket.
+func (s *socket) Stats() SocketStats {
+	stats := s.stats.snapshot()
+	stats.ReadBufferSize = readBuffer
+	stats.WriteBufferSize = writeBuffer
+	stats.KeepAlive = keepAlive
+	return stats
+}
+
+// registry tracks every live *socket so Walk can enumerate them.
+var registry sync.Map // map[*socket]struct{}
+
+func register(s *socket) {
+	registry.Store(s, struct{}{})
+}
+
+func deregister(s *socket) {
+	registry.Delete(s)
+}
+
+// Walk calls fn for every Socket created via NewSocket or GetSocket that has
+// not been permanently discarded (sockets returned to the pool via Close
+// stay registered, ready to be reused). Walk stops early if fn returns
+// false.
+func Walk(fn func(Socket) bool) {
+	registry.Range(func(key, _ interface{}) bool {
+		return fn(key.(*socket))
+	})
+}
@@ -0,0 +1,277 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ net.Conn = (*Stream)(nil)
+
+// A Stream is one logical, independently flow-controlled connection
+// multiplexed over a Session's Socket. It implements net.Conn, and also
+// exposes WritePacket/ReadPacket so callers can dispatch calls/pushes on it
+// exactly like a plain Socket.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	recvBuf      bytes.Buffer
+	recvCredit   int32 // atomic: unreported bytes consumed since the last WIN
+	sendWindow   int32 // credit granted by the peer, decremented on send
+	remoteClosed bool
+	closeErr     error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closeOnce sync.Once
+
+	pSockOnce sync.Once
+	pSock     Socket
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	st := &Stream{
+		id:         id,
+		sess:       sess,
+		sendWindow: int32(sess.config.MaxReceiveBuffer),
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// LocalAddr returns the local network address of the underlying Session.
+func (st *Stream) LocalAddr() net.Addr { return st.sess.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address of the underlying Session.
+func (st *Stream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+// SetDeadline sets both the read and write deadlines for the Stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls and any
+// currently-blocked Read call.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls and any
+// currently-blocked Write call.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	return nil
+}
+
+// Read reads data from the stream, blocking until data arrives, the peer
+// half-closes the stream (io.EOF), or the stream is closed or times out.
+func (st *Stream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	st.mu.Lock()
+	for {
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(b)
+			st.mu.Unlock()
+			st.grantCredit(n)
+			return n, nil
+		}
+		if st.closeErr != nil {
+			err := st.closeErr
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if !st.readDeadline.IsZero() && !time.Now().Before(st.readDeadline) {
+			st.mu.Unlock()
+			return 0, errTimeout
+		}
+		if !st.readDeadline.IsZero() {
+			timer := time.AfterFunc(time.Until(st.readDeadline), st.cond.Broadcast)
+			st.cond.Wait()
+			timer.Stop()
+		} else {
+			st.cond.Wait()
+		}
+	}
+}
+
+// grantCredit reports n newly-consumed bytes back to the peer once enough
+// has accumulated, so its sendWindow for this stream is replenished.
+func (st *Stream) grantCredit(n int) {
+	if n <= 0 {
+		return
+	}
+	threshold := int32(st.sess.config.MaxReceiveBuffer / 2)
+	if threshold <= 0 {
+		threshold = 1
+	}
+	if atomic.AddInt32(&st.recvCredit, int32(n)) < threshold {
+		return
+	}
+	delta := atomic.SwapInt32(&st.recvCredit, 0)
+	f := newFrame(cmdWIN, st.id)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(delta))
+	f.data = buf[:]
+	st.sess.writeFrame(f, prioCtrl)
+}
+
+// Write writes b to the stream, splitting it into frames no larger than the
+// Session's MaxFrameSize and blocking for flow-control credit as needed so a
+// slow peer reader cannot be overrun.
+func (st *Stream) Write(b []byte) (int, error) {
+	sent := 0
+	max := st.sess.config.MaxFrameSize
+	for sent < len(b) {
+		n := len(b) - sent
+		if n > max {
+			n = max
+		}
+		if err := st.writeChunk(b[sent : sent+n]); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+func (st *Stream) writeChunk(chunk []byte) error {
+	if err := st.waitSendWindow(len(chunk)); err != nil {
+		return err
+	}
+	f := newFrame(cmdPSH, st.id)
+	f.data = chunk
+	if err := st.sess.writeFrame(f, prioData); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	st.sendWindow -= int32(len(chunk))
+	st.mu.Unlock()
+	return nil
+}
+
+func (st *Stream) waitSendWindow(n int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for st.sendWindow < int32(n) {
+		if st.closeErr != nil {
+			return st.closeErr
+		}
+		if !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline) {
+			return errTimeout
+		}
+		if !st.writeDeadline.IsZero() {
+			timer := time.AfterFunc(time.Until(st.writeDeadline), st.cond.Broadcast)
+			st.cond.Wait()
+			timer.Stop()
+		} else {
+			st.cond.Wait()
+		}
+	}
+	return nil
+}
+
+// Close closes the Stream, notifying the peer with a FIN unless it already
+// half-closed its own side.
+func (st *Stream) Close() error {
+	var err error
+	st.closeOnce.Do(func() {
+		st.sess.removeStream(st.id)
+		st.mu.Lock()
+		alreadyRemoteClosed := st.remoteClosed
+		if st.closeErr == nil {
+			st.closeErr = io.ErrClosedPipe
+		}
+		st.cond.Broadcast()
+		st.mu.Unlock()
+		if !alreadyRemoteClosed && !st.sess.IsClosed() {
+			err = st.sess.writeFrame(newFrame(cmdFIN, st.id), prioCtrl)
+		}
+	})
+	return err
+}
+
+// closeWithError is called by the Session when it fails, unblocking any
+// pending Read/Write with the Session's error instead of a plain EOF.
+func (st *Stream) closeWithError(err error) {
+	st.mu.Lock()
+	if st.closeErr == nil {
+		st.closeErr = err
+	}
+	st.remoteClosed = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// packetSocket lazily wraps the Stream as a Socket so WritePacket/ReadPacket
+// can reuse the ordinary Proto pack/unpack machinery instead of reimplementing
+// it. This wrapper is an internal implementation detail of the Stream, not a
+// connection of its own, so it is immediately taken out of the package-level
+// registry NewSocket put it in: otherwise every Stream that ever exchanges a
+// packet would leak a permanent Walk entry holding a strong reference to
+// itself (and transitively its Session), defeating GC forever.
+func (st *Stream) packetSocket() Socket {
+	st.pSockOnce.Do(func() {
+		st.pSock = NewSocket(st, st.sess.protoFunc...)
+		if s, ok := st.pSock.(*socket); ok {
+			deregister(s)
+		}
+	})
+	return st.pSock
+}
+
+// WritePacket writes header and body to the stream.
+func (st *Stream) WritePacket(packet *Packet) error {
+	return st.packetSocket().WritePacket(packet)
+}
+
+// ReadPacket reads header and body from the stream.
+func (st *Stream) ReadPacket(packet *Packet) error {
+	return st.packetSocket().ReadPacket(packet)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "socket: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout error = timeoutError{}
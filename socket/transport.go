@@ -0,0 +1,268 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/henrylee2cn/goutil/errors"
+)
+
+// A ConnWrapper transforms a net.Conn into another one, e.g. negotiating
+// TLS or tunneling through a proxy, before it is handed to NewSocket/GetSocket
+// for protocol framing. This eliminates the usual boilerplate of manually
+// dialing TLS or a proxy before handing the conn to teleport.
+type ConnWrapper func(net.Conn) (net.Conn, error)
+
+// DialWithWrappers dials network/address and applies wrappers, in order, to
+// the resulting net.Conn. The result is ready to pass to NewSocket/GetSocket,
+// and a Reconnector's Dialer can call it again on each reconnect to
+// re-negotiate the same transport chain.
+func DialWithWrappers(network, address string, wrappers ...ConnWrapper) (net.Conn, error) {
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return applyWrappers(c, wrappers)
+}
+
+func applyWrappers(c net.Conn, wrappers []ConnWrapper) (net.Conn, error) {
+	var err error
+	for _, wrap := range wrappers {
+		c, err = wrap(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// WithTLS returns a ConnWrapper that negotiates TLS as the client, for
+// dialing out to a TLS-terminated peer.
+func WithTLS(cfg *tls.Config) ConnWrapper {
+	return func(c net.Conn) (net.Conn, error) {
+		tc := tls.Client(c, cfg)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+// WithTLSServer returns a ConnWrapper that negotiates TLS as the server, for
+// accepting connections that must be TLS-terminated.
+func WithTLSServer(cfg *tls.Config) ConnWrapper {
+	return func(c net.Conn) (net.Conn, error) {
+		tc := tls.Server(c, cfg)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+// SOCKS5Auth carries optional username/password credentials for the SOCKS5
+// handshake performed by WithSOCKS5.
+type SOCKS5Auth struct {
+	User     string
+	Password string
+}
+
+// WithSOCKS5 returns a ConnWrapper that, given a conn already dialed to a
+// SOCKS5 proxy, performs the SOCKS5 handshake and asks the proxy to CONNECT
+// to target, so the returned conn behaves as if dialed straight to target.
+// auth may be nil to request no authentication.
+func WithSOCKS5(target string, auth *SOCKS5Auth) ConnWrapper {
+	return func(c net.Conn) (net.Conn, error) {
+		if err := socks5Handshake(c, target, auth); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+func socks5Handshake(c net.Conn, target string, auth *SOCKS5Auth) error {
+	methods := []byte{0x00}
+	if auth != nil {
+		methods = []byte{0x02, 0x00}
+	}
+	greeting := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := c.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("socket: unexpected SOCKS5 version in server reply")
+	}
+	switch reply[1] {
+	case 0x00:
+		// no authentication required
+	case 0x02:
+		if auth == nil {
+			return errors.New("socket: SOCKS5 proxy requires username/password authentication")
+		}
+		if err := socks5Authenticate(c, auth); err != nil {
+			return err
+		}
+	default:
+		return errors.New("socket: SOCKS5 proxy offered no acceptable authentication method")
+	}
+	return socks5Connect(c, target)
+}
+
+func socks5Authenticate(c net.Conn, auth *SOCKS5Auth) error {
+	req := []byte{0x01, byte(len(auth.User))}
+	req = append(req, auth.User...)
+	req = append(req, byte(len(auth.Password)))
+	req = append(req, auth.Password...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("socket: SOCKS5 proxy rejected username/password authentication")
+	}
+	return nil
+}
+
+func socks5Connect(c net.Conn, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socket: SOCKS5 proxy refused CONNECT to %s (code %d)", target, head[1])
+	}
+	var addrLen int
+	switch head[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return errors.New("socket: unknown SOCKS5 address type in CONNECT reply")
+	}
+	_, err = io.ReadFull(c, make([]byte, addrLen+2)) // bound address + port, discarded
+	return err
+}
+
+// WithHTTPProxy returns a ConnWrapper that, given a conn already dialed to an
+// HTTP proxy, issues an HTTP CONNECT request for target and returns a conn
+// tunneled to it once the proxy replies 200.
+func WithHTTPProxy(target string) ConnWrapper {
+	return func(c net.Conn) (net.Conn, error) {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: target},
+			Host:   target,
+			Header: make(http.Header),
+		}
+		if err := req.Write(c); err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("socket: HTTP CONNECT to %s failed: %s", target, resp.Status)
+		}
+		// br may have buffered bytes the proxy already sent past the
+		// response headers; keep serving those before reading from c directly.
+		if br.Buffered() == 0 {
+			return c, nil
+		}
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+}
+
+// bufferedConn serves bytes buffered ahead of an HTTP CONNECT response
+// before falling through to the raw conn, so the proxy's leftover read-ahead
+// isn't silently dropped.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+// Unwrap returns the wrapped conn, so optimize() can still reach the
+// innermost *net.TCPConn through a bufferedConn.
+func (b *bufferedConn) Unwrap() net.Conn { return b.Conn }
+
+// underlyingConn unwraps a net.Conn that wraps another one (as *tls.Conn and
+// bufferedConn do) until it reaches the innermost conn, mirroring the
+// SyscallConn-style unwrapping net/http uses to reach TCP-level knobs
+// through an arbitrary transport chain.
+func underlyingConn(c net.Conn) net.Conn {
+	for {
+		switch v := c.(type) {
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		case interface{ Unwrap() net.Conn }:
+			c = v.Unwrap()
+		default:
+			return c
+		}
+	}
+}
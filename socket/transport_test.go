@@ -0,0 +1,190 @@
+// Socket package provides a concise, powerful and high-performance TCP socket.
+//
+// Copyright 2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package socket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSocks5HandshakeNoAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- fakeSocks5Server(server, false) }()
+
+	if err := socks5Handshake(client, "example.com:443", nil); err != nil {
+		t.Fatalf("socks5Handshake: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("fake SOCKS5 server: %v", err)
+	}
+}
+
+func TestSocks5HandshakeWithAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- fakeSocks5Server(server, true) }()
+
+	auth := &SOCKS5Auth{User: "u", Password: "p"}
+	if err := socks5Handshake(client, "10.0.0.1:22", auth); err != nil {
+		t.Fatalf("socks5Handshake: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("fake SOCKS5 server: %v", err)
+	}
+}
+
+func TestSocks5HandshakeRequiresAuthWhenOffered(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		// Server always demands username/password, regardless of the client's
+		// greeting, to exercise socks5Handshake's "no creds supplied" error path.
+		greeting := make([]byte, 2)
+		io.ReadFull(server, greeting)
+		io.ReadFull(server, make([]byte, greeting[1]))
+		server.Write([]byte{0x05, 0x02})
+	}()
+
+	if err := socks5Handshake(client, "example.com:443", nil); err == nil {
+		t.Fatal("socks5Handshake: want error when proxy requires auth but none was supplied")
+	}
+}
+
+// fakeSocks5Server plays the server side of the handshake socks5Handshake
+// drives, optionally requiring username/password authentication, and always
+// succeeds the final CONNECT with an IPv4 bound address.
+func fakeSocks5Server(c net.Conn, requireAuth bool) error {
+	defer c.Close()
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(c, greeting); err != nil {
+		return err
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+	method := byte(0x00)
+	if requireAuth {
+		method = 0x02
+	}
+	if _, err := c.Write([]byte{0x05, method}); err != nil {
+		return err
+	}
+	if requireAuth {
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, make([]byte, hdr[1])); err != nil {
+			return err
+		}
+		plen := make([]byte, 1)
+		if _, err := io.ReadFull(c, plen); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, make([]byte, plen[0])); err != nil {
+			return err
+		}
+		if _, err := c.Write([]byte{0x01, 0x00}); err != nil {
+			return err
+		}
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	var addrLen int
+	switch head[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	}
+	if _, err := io.ReadFull(c, make([]byte, addrLen+2)); err != nil {
+		return err
+	}
+	reply := append([]byte{0x05, 0x00, 0x00, 0x01}, make([]byte, net.IPv4len+2)...)
+	_, err := c.Write(reply)
+	return err
+}
+
+func TestWithHTTPProxySuccessPreservesLeftoverBytes(t *testing.T) {
+	client, server := net.Pipe()
+
+	go func() {
+		br := bufio.NewReader(server)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			server.Close()
+			return
+		}
+		req.Body.Close()
+		io.WriteString(server, "HTTP/1.1 200 Connection Established\r\n\r\nleftover")
+		server.Close()
+	}()
+
+	tunneled, err := WithHTTPProxy("example.com:443")(client)
+	if err != nil {
+		t.Fatalf("WithHTTPProxy wrapper: %v", err)
+	}
+	defer tunneled.Close()
+
+	buf := make([]byte, len("leftover"))
+	if _, err := io.ReadFull(tunneled, buf); err != nil {
+		t.Fatalf("reading bytes buffered ahead of the CONNECT response: %v", err)
+	}
+	if string(buf) != "leftover" {
+		t.Fatalf("got %q, want %q", buf, "leftover")
+	}
+}
+
+func TestWithHTTPProxyNonOKStatus(t *testing.T) {
+	client, server := net.Pipe()
+
+	go func() {
+		br := bufio.NewReader(server)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			server.Close()
+			return
+		}
+		req.Body.Close()
+		io.WriteString(server, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		server.Close()
+	}()
+
+	if _, err := WithHTTPProxy("example.com:443")(client); err == nil {
+		t.Fatal("WithHTTPProxy: want error on a non-200 CONNECT response")
+	}
+}